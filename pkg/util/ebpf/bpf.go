@@ -118,6 +118,19 @@ func IsEnableBTF() (bool, error) {
 	return true, nil
 }
 
+// ExternalBTFPath resolves a BTF file for hosts whose kernel wasn't built
+// with CONFIG_DEBUG_INFO_BTF=y, so CO-RE-based modules keep working on
+// RHEL 7, older Ubuntu LTS, Amazon Linux 2 and similar distros. Callers
+// should only need this when IsEnableBTF() returns false; the resolved path
+// is meant to be fed into manager.Options.VerifierOptions.Programs.KernelTypes.
+func ExternalBTFPath(cacheDir string) (string, error) {
+	uname, err := getOSUnamer()
+	if err != nil {
+		return "", err
+	}
+	return ResolveExternalBTF(uname, cacheDir)
+}
+
 // check BPF CONFIG
 func IsEnableBPF() (bool, error) {
 	var e error
@@ -0,0 +1,193 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"ecapture/assets"
+)
+
+// DefaultBTFCacheDir is where resolved external BTF files are cached; an
+// airgapped host's cache can be pre-populated with PrePopulateBTFCache.
+const DefaultBTFCacheDir = "/var/lib/ecapture/btf/"
+
+// BTFHubMirror is the default mirror external BTF files are downloaded from
+// when they're missing from both the local cache and the bundled assets. An
+// empty value disables download-on-demand.
+var BTFHubMirror = ""
+
+// btfOSRelease is the subset of /etc/os-release fields needed to build a
+// BTFHub-style lookup key.
+type btfOSRelease struct {
+	ID        string
+	VersionID string
+}
+
+// ResolveExternalBTF returns the path to a BTF file matching uname on a
+// kernel that wasn't built with CONFIG_DEBUG_INFO_BTF=y (common on RHEL 7,
+// older Ubuntu LTS, Amazon Linux 2 and many embedded distros). It searches,
+// in order: the local cache dir, the BTF files bundled in the assets package, and finally the
+// download mirror named by BTFHubMirror (empty disables that tier).
+func ResolveExternalBTF(uname *UnameInfo, cacheDir string) (string, error) {
+	return resolveExternalBTF(uname, cacheDir, BTFHubMirror)
+}
+
+func resolveExternalBTF(uname *UnameInfo, cacheDir, mirror string) (string, error) {
+	osRelease, err := readOSRelease("/etc/os-release")
+	if err != nil {
+		return "", fmt.Errorf("couldn't read /etc/os-release: %v", err)
+	}
+
+	key := btfHubKey(osRelease, uname)
+
+	if cacheDir == "" {
+		cacheDir = DefaultBTFCacheDir
+	}
+	cachedPath := filepath.Join(cacheDir, key)
+	if _, err := os.Stat(cachedPath); err == nil {
+		return cachedPath, nil
+	}
+
+	if path, err := extractBundledBTF(key, cacheDir); err == nil {
+		return path, nil
+	}
+
+	if mirror != "" {
+		path, err := downloadBTF(mirror, key, cacheDir)
+		if err == nil {
+			return path, nil
+		}
+		return "", fmt.Errorf("no external BTF found for %s, and fetching it from the mirror failed: %v", key, err)
+	}
+
+	return "", fmt.Errorf("no external BTF found for %s, and no mirror configured to fetch it", key)
+}
+
+// btfHubKey builds a lookup key in the same shape BTFHub uses, e.g.
+// "ubuntu/20.04/x86_64/5.4.0-125-generic.btf".
+func btfHubKey(osRelease *btfOSRelease, uname *UnameInfo) string {
+	return fmt.Sprintf("%s/%s/%s/%s.btf", osRelease.ID, osRelease.VersionID, uname.Machine, uname.Release)
+}
+
+func readOSRelease(path string) (*btfOSRelease, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	osRelease := &btfOSRelease{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch key {
+		case "ID":
+			osRelease.ID = value
+		case "VERSION_ID":
+			osRelease.VersionID = value
+		}
+	}
+
+	if osRelease.ID == "" || osRelease.VersionID == "" {
+		return nil, fmt.Errorf("missing ID/VERSION_ID in %s", path)
+	}
+	return osRelease, scanner.Err()
+}
+
+// bundledBTFAssetPath is where a bundled BTF file for key would live in the
+// assets bindata, mirroring how postgres_kern.o is loaded through
+// assets.Asset() elsewhere in this codebase.
+func bundledBTFAssetPath(key string) string {
+	return "assets/btf/" + key
+}
+
+// extractBundledBTF pulls key out of the BTF catalog embedded via the assets
+// package and caches it under cacheDir, so repeated lookups hit the
+// filesystem cache instead of re-reading the embedded bindata.
+func extractBundledBTF(key, cacheDir string) (string, error) {
+	data, err := assets.Asset(bundledBTFAssetPath(key))
+	if err != nil {
+		return "", fmt.Errorf("no bundled BTF for %s: %v", key, err)
+	}
+
+	destPath := filepath.Join(cacheDir, key)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(destPath, data, 0o644); err != nil {
+		return "", err
+	}
+
+	return destPath, nil
+}
+
+// downloadBTF fetches key from mirror and caches it under cacheDir.
+func downloadBTF(mirror, key, cacheDir string) (string, error) {
+	url := strings.TrimRight(mirror, "/") + "/" + key
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("mirror returned %s for %s", resp.Status, url)
+	}
+
+	destPath := filepath.Join(cacheDir, key)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+		return "", err
+	}
+
+	out, err := os.Create(destPath)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		os.Remove(destPath)
+		return "", err
+	}
+
+	return destPath, nil
+}
+
+// PrePopulateBTFCache resolves and caches the external BTF for uname using
+// mirror for the download tier, so an airgapped host's cache can be warmed
+// ahead of time from a machine that does have network access. It takes
+// mirror as a parameter rather than going through the package-level
+// BTFHubMirror var, so warming the cache once doesn't leave download-on-demand
+// permanently switched on for every later ResolveExternalBTF call in the
+// process.
+//
+// This is the building block an `ecapture btf` subcommand would call to let a
+// user pre-populate the cache; no such subcommand exists yet, since the CLI's
+// cmd package isn't part of this change.
+func PrePopulateBTFCache(uname *UnameInfo, cacheDir, mirror string) (string, error) {
+	return resolveExternalBTF(uname, cacheDir, mirror)
+}
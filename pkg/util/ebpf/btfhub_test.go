@@ -0,0 +1,77 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBtfHubKey(t *testing.T) {
+	osRelease := &btfOSRelease{ID: "ubuntu", VersionID: "20.04"}
+	uname := &UnameInfo{Machine: "x86_64", Release: "5.4.0-125-generic"}
+
+	got := btfHubKey(osRelease, uname)
+	want := "ubuntu/20.04/x86_64/5.4.0-125-generic.btf"
+	if got != want {
+		t.Errorf("btfHubKey() = %q, want %q", got, want)
+	}
+}
+
+func TestReadOSRelease(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "os-release")
+	content := "NAME=\"Ubuntu\"\nID=ubuntu\nVERSION_ID=\"20.04\"\nPRETTY_NAME=\"Ubuntu 20.04.6 LTS\"\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	osRelease, err := readOSRelease(path)
+	if err != nil {
+		t.Fatalf("readOSRelease() returned error: %v", err)
+	}
+	if osRelease.ID != "ubuntu" || osRelease.VersionID != "20.04" {
+		t.Errorf("readOSRelease() = %+v, want ID=ubuntu VERSION_ID=20.04", osRelease)
+	}
+}
+
+func TestReadOSRelease_MissingFields(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "os-release")
+	if err := os.WriteFile(path, []byte("NAME=\"Ubuntu\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readOSRelease(path); err == nil {
+		t.Fatal("readOSRelease() should fail when ID/VERSION_ID are missing")
+	}
+}
+
+func TestPrePopulateBTFCache_DoesNotMutateBTFHubMirror(t *testing.T) {
+	before := BTFHubMirror
+	defer func() { BTFHubMirror = before }()
+	BTFHubMirror = ""
+
+	// Resolution itself will fail in this sandbox (no /etc/os-release match,
+	// no bundled asset, no real mirror), but PrePopulateBTFCache must not
+	// leave the package-level BTFHubMirror switched on as a side effect
+	// regardless of whether it succeeds.
+	_, _ = PrePopulateBTFCache(&UnameInfo{Machine: "x86_64", Release: "5.4.0-125-generic"}, t.TempDir(), "https://example.invalid/btf")
+
+	if BTFHubMirror != "" {
+		t.Errorf("BTFHubMirror = %q, want it left untouched by PrePopulateBTFCache", BTFHubMirror)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ebpf
+
+import (
+	"fmt"
+
+	"ecapture/pkg/util/kernel"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+)
+
+// Feature is a concrete eBPF capability a module may depend on, probed by
+// attempting the smallest program/map that would exercise it rather than by
+// trusting a kernel-version heuristic alone.
+type Feature string
+
+const (
+	FeatureRingBuf          Feature = "ringbuf"
+	FeatureBPFProbeReadUser Feature = "bpf_probe_read_user_str"
+	FeatureCORERelocation   Feature = "core_relocation"
+)
+
+// PreflightReport is the result of a Preflight check, returned so callers
+// (the CLI, `--list`, `--json-capabilities`) can surface it to the user
+// instead of letting the module fail later with a cryptic verifier error.
+type PreflightReport struct {
+	HostKernelVersion kernel.Version
+	MinKernelVersion  kernel.Version
+	KernelOK          bool
+	Features          map[Feature]bool
+	Warnings          []string
+}
+
+// Preflight checks the running host against a module's minimum kernel
+// version and required features, recording a WARNING in the report's
+// Warnings for anything missing so the caller can print it, instead of
+// letting the module fail later with a cryptic verifier error. Preflight
+// itself logs nothing.
+func Preflight(minVersion kernel.Version, requiredFeatures []Feature) (*PreflightReport, error) {
+	hostVersion, err := kernel.HostVersion()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't determine host kernel version: %v", err)
+	}
+
+	report := &PreflightReport{
+		HostKernelVersion: hostVersion,
+		MinKernelVersion:  minVersion,
+		KernelOK:          hostVersion >= minVersion,
+		Features:          make(map[Feature]bool, len(requiredFeatures)),
+	}
+
+	if !report.KernelOK {
+		report.Warnings = append(report.Warnings, fmt.Sprintf(
+			"WARNING requires kernel >=%s, current %s", minVersion, hostVersion))
+	}
+
+	for _, feature := range requiredFeatures {
+		ok := probeFeature(feature)
+		report.Features[feature] = ok
+		if !ok {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("WARNING feature %q is not available on this host", feature))
+		}
+	}
+
+	return report, nil
+}
+
+// probeFeature attempts the smallest program/map that would exercise
+// feature, returning whether the kernel accepted it.
+func probeFeature(feature Feature) bool {
+	switch feature {
+	case FeatureRingBuf:
+		return probeRingBufMap()
+	case FeatureBPFProbeReadUser:
+		return probeHelperCall(asm.FnProbeReadUserStr)
+	case FeatureCORERelocation:
+		// CO-RE relocation needs BTF, either the kernel's own or a resolved
+		// external one; reuse the same check the rest of the ebpf package
+		// already does instead of re-deriving it from the kernel version.
+		if ok, err := IsEnableBTF(); err == nil && ok {
+			return true
+		}
+		_, err := ExternalBTFPath(DefaultBTFCacheDir)
+		return err == nil
+	default:
+		return true
+	}
+}
+
+// helperBuiltins maps the helper names a module might list in
+// Requirements.RequiredHelpers to the asm.BuiltinFunc probeHelperCall needs;
+// only the helpers eCapture modules actually depend on are listed here.
+var helperBuiltins = map[string]asm.BuiltinFunc{
+	"bpf_probe_read_user_str": asm.FnProbeReadUserStr,
+	"bpf_probe_read_user":     asm.FnProbeReadUser,
+	"bpf_ringbuf_output":      asm.FnRingbufOutput,
+}
+
+// ProbeHelpers probes each of names and reports whether the host's kernel
+// accepts it, so a module's Requirements.RequiredHelpers can be checked the
+// same way RequiredConfigs is: against what was actually observed on this
+// host, not a version-number guess. A name eCapture doesn't know how to probe
+// is reported as unavailable rather than silently skipped.
+func ProbeHelpers(names []string) map[string]bool {
+	result := make(map[string]bool, len(names))
+	for _, name := range names {
+		fn, known := helperBuiltins[name]
+		result[name] = known && probeHelperCall(fn)
+	}
+	return result
+}
+
+// probeRingBufMap attempts to create a throwaway BPF_MAP_TYPE_RINGBUF map,
+// the cheapest way to check ringbuf support (needs kernel >= 5.8).
+func probeRingBufMap() bool {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.RingBuf,
+		MaxEntries: 4096,
+	})
+	if err != nil {
+		return false
+	}
+	_ = m.Close()
+	return true
+}
+
+// probeHelperCall attempts to load a minimal throwaway kprobe program that
+// calls fn, the cheapest way to check a helper is available without
+// depending on a kernel-version table that's forever playing catch-up with
+// backports.
+func probeHelperCall(fn asm.BuiltinFunc) bool {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:    ebpf.Kprobe,
+		License: "GPL",
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R1, 0),
+			asm.Mov.Imm(asm.R2, 0),
+			asm.Mov.Imm(asm.R3, 0),
+			fn.Call(),
+			asm.Mov.Imm(asm.R0, 0),
+			asm.Return(),
+		},
+	})
+	if err != nil {
+		return false
+	}
+	_ = prog.Close()
+	return true
+}
@@ -0,0 +1,66 @@
+//go:build !androidgki
+
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "errors"
+
+// IConfig is implemented by every module's config, letting the module
+// loader validate flags before calling Module.Init().
+type IConfig interface {
+	Check() error
+}
+
+var (
+	errPostgresMissingPath        = errors.New("postgres module requires --postgres-path (or --client with --openssl-path)")
+	errPostgresMissingOpensslPath = errors.New("postgres --client mode requires --openssl-path")
+)
+
+// PostgresConfig holds the flags for the postgres module: tracing the
+// server binary directly (the default), or --client mode, which instead
+// reuses the openssl module's SSL_read/SSL_write uprobes to observe
+// TLS-wrapped traffic client-side (psql, pgbouncer) when sslmode=require
+// hides the query text from the server-side exec_simple_query uprobe.
+type PostgresConfig struct {
+	// PostgresPath is the path to the postgres server binary to trace.
+	// Required unless ClientMode is set.
+	PostgresPath string
+
+	// FuncName overrides the auto-detected uprobe attach point, for
+	// non-stock/rebuilt binaries detectPostgresVersion can't identify.
+	FuncName string
+
+	// ClientMode observes TLS-wrapped Postgres traffic client-side instead
+	// of tracing the server binary.
+	ClientMode bool
+
+	// OpensslPath is the path to the openssl-linked client binary to trace
+	// when ClientMode is set (e.g. psql, pgbouncer).
+	OpensslPath string
+}
+
+func (c *PostgresConfig) Check() error {
+	if c.ClientMode {
+		if c.OpensslPath == "" {
+			return errPostgresMissingOpensslPath
+		}
+		return nil
+	}
+	if c.PostgresPath == "" {
+		return errPostgresMissingPath
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+//go:build !androidgki
+
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	postgresClientCommSize = 16
+	postgresClientDataSize = 4096
+)
+
+// PostgresClientEvent carries one decrypted SSL_read/SSL_write buffer
+// observed on the client side (psql, pgbouncer, ...), keyed by (pid,
+// ssl_ptr) so the user-side decoder can reassemble the Postgres wire
+// protocol out of however SSL happened to chunk it.
+type PostgresClientEvent struct {
+	Pid        uint32
+	Tid        uint32
+	Comm       [postgresClientCommSize]byte
+	SSLPointer uint64
+	IsWrite    uint8
+	_          [7]byte // padding to match the kernel-side struct layout
+	DataLen    uint32
+	Data       [postgresClientDataSize]byte
+}
+
+func (pe *PostgresClientEvent) Decode(payload []byte) error {
+	buf := bytes.NewBuffer(payload)
+	return binary.Read(buf, binary.LittleEndian, pe)
+}
+
+// DataBytes returns the portion of Data actually filled in by the kernel side.
+func (pe *PostgresClientEvent) DataBytes() []byte {
+	size := pe.DataLen
+	if size > uint32(len(pe.Data)) {
+		size = uint32(len(pe.Data))
+	}
+	return pe.Data[:size]
+}
+
+func (pe *PostgresClientEvent) String() string {
+	direction := "SSL_read"
+	if pe.IsWrite != 0 {
+		direction = "SSL_write"
+	}
+	return fmt.Sprintf("PID:%d, Comm:%s, %s, bytes:%d", pe.Pid, bytes.TrimRight(pe.Comm[:], "\x00"), direction, pe.DataLen)
+}
+
+func (pe *PostgresClientEvent) Clone() IEventStruct {
+	return new(PostgresClientEvent)
+}
+
+func (pe *PostgresClientEvent) EventType() EventType {
+	return EventTypeEventProcessor
+}
@@ -0,0 +1,106 @@
+//go:build !androidgki
+
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// PostgresMessageType identifies which Extended Query Protocol message produced the event.
+type PostgresMessageType uint8
+
+const (
+	PostgresMessageParse PostgresMessageType = iota
+	PostgresMessageBind
+	PostgresMessageExecute
+)
+
+func (t PostgresMessageType) String() string {
+	switch t {
+	case PostgresMessageParse:
+		return "Parse"
+	case PostgresMessageBind:
+		return "Bind"
+	case PostgresMessageExecute:
+		return "Execute"
+	default:
+		return "Unknown"
+	}
+}
+
+const (
+	postgresExtStatementNameSize = 64
+	postgresExtPortalNameSize    = 64
+	postgresExtQuerySize         = 512
+	postgresExtParamsSize        = 512
+	postgresExtCommSize          = 16
+)
+
+// PostgresExtendedEvent carries a single Parse/Bind/Execute message captured from the
+// Extended Query Protocol. The user-side decoder stitches these together using
+// (Pid, StatementName) before presenting a logical statement to the user.
+type PostgresExtendedEvent struct {
+	MessageType    PostgresMessageType
+	Pid            uint32
+	Tid            uint32
+	Comm           [postgresExtCommSize]byte
+	StatementName  [postgresExtStatementNameSize]byte
+	PortalName     [postgresExtPortalNameSize]byte
+	Query          [postgresExtQuerySize]byte
+	Parameters     [postgresExtParamsSize]byte
+	ParametersSize uint32
+}
+
+func (pe *PostgresExtendedEvent) Decode(payload []byte) error {
+	buf := bytes.NewBuffer(payload)
+	return binary.Read(buf, binary.LittleEndian, pe)
+}
+
+func (pe *PostgresExtendedEvent) StatementNameString() string {
+	return string(bytes.TrimRight(pe.StatementName[:], "\x00"))
+}
+
+func (pe *PostgresExtendedEvent) PortalNameString() string {
+	return string(bytes.TrimRight(pe.PortalName[:], "\x00"))
+}
+
+func (pe *PostgresExtendedEvent) QueryString() string {
+	return string(bytes.TrimRight(pe.Query[:], "\x00"))
+}
+
+func (pe *PostgresExtendedEvent) ParametersString() string {
+	size := pe.ParametersSize
+	if size > uint32(len(pe.Parameters)) {
+		size = uint32(len(pe.Parameters))
+	}
+	return string(bytes.TrimRight(pe.Parameters[:size], "\x00"))
+}
+
+func (pe *PostgresExtendedEvent) String() string {
+	return fmt.Sprintf("PID:%d, Comm:%s, Type:%s, Statement:%s, Portal:%s, Query:%s, Parameters:%s",
+		pe.Pid, bytes.TrimRight(pe.Comm[:], "\x00"), pe.MessageType, pe.StatementNameString(), pe.PortalNameString(), pe.QueryString(), pe.ParametersString())
+}
+
+func (pe *PostgresExtendedEvent) Clone() IEventStruct {
+	return new(PostgresExtendedEvent)
+}
+
+func (pe *PostgresExtendedEvent) EventType() EventType {
+	return EventTypeEventProcessor
+}
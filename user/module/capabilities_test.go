@@ -0,0 +1,122 @@
+//go:build !androidgki
+
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"ecapture/pkg/util/kernel"
+	"testing"
+)
+
+func TestRequirements_Supported_KernelTooOld(t *testing.T) {
+	r := Requirements{MinKernel: kernel.VersionCode(5, 8, 0)}
+
+	ok, reason := r.Supported(kernel.VersionCode(5, 4, 0), nil, nil)
+	if ok {
+		t.Fatalf("expected unsupported, got supported")
+	}
+	if reason == "" {
+		t.Errorf("expected a non-empty reason")
+	}
+}
+
+func TestRequirements_Supported_MissingConfig(t *testing.T) {
+	r := Requirements{
+		MinKernel:       kernel.VersionCode(5, 8, 0),
+		RequiredConfigs: []string{"CONFIG_BPF", "CONFIG_UPROBES"},
+	}
+	hostConfigs := map[string]string{"CONFIG_BPF": "y"}
+
+	ok, reason := r.Supported(kernel.VersionCode(5, 10, 0), hostConfigs, nil)
+	if ok {
+		t.Fatalf("expected unsupported due to missing CONFIG_UPROBES, got supported")
+	}
+	if reason == "" {
+		t.Errorf("expected a non-empty reason")
+	}
+}
+
+func TestRequirements_Supported_OK(t *testing.T) {
+	r := Requirements{
+		MinKernel:       kernel.VersionCode(5, 8, 0),
+		RequiredConfigs: []string{"CONFIG_BPF", "CONFIG_UPROBES"},
+	}
+	hostConfigs := map[string]string{"CONFIG_BPF": "y", "CONFIG_UPROBES": "y"}
+
+	ok, reason := r.Supported(kernel.VersionCode(5, 15, 0), hostConfigs, nil)
+	if !ok {
+		t.Fatalf("expected supported, got unsupported: %s", reason)
+	}
+}
+
+func TestRequirements_Supported_MissingHelper(t *testing.T) {
+	r := Requirements{
+		MinKernel:       kernel.VersionCode(5, 8, 0),
+		RequiredHelpers: []string{"bpf_probe_read_user_str"},
+	}
+	hostHelpers := map[string]bool{"bpf_probe_read_user_str": false}
+
+	ok, reason := r.Supported(kernel.VersionCode(5, 15, 0), nil, hostHelpers)
+	if ok {
+		t.Fatalf("expected unsupported due to missing helper, got supported")
+	}
+	if reason == "" {
+		t.Errorf("expected a non-empty reason")
+	}
+}
+
+func TestRequirements_Supported_HelperOK(t *testing.T) {
+	r := Requirements{
+		MinKernel:       kernel.VersionCode(5, 8, 0),
+		RequiredHelpers: []string{"bpf_probe_read_user_str"},
+	}
+	hostHelpers := map[string]bool{"bpf_probe_read_user_str": true}
+
+	ok, reason := r.Supported(kernel.VersionCode(5, 15, 0), nil, hostHelpers)
+	if !ok {
+		t.Fatalf("expected supported, got unsupported: %s", reason)
+	}
+}
+
+// fakeRequirementsModule lets RegisterIfSupported be tested without pulling
+// in a real module's Init/Start machinery.
+type fakeRequirementsModule struct {
+	requirements Requirements
+}
+
+func (m fakeRequirementsModule) Requirements() Requirements { return m.requirements }
+
+func TestRegisterIfSupported_RegistersWhenKernelRequirementTrivial(t *testing.T) {
+	mod := fakeRequirementsModule{requirements: Requirements{MinKernel: kernel.VersionCode(1, 0, 0)}}
+	registered := false
+
+	RegisterIfSupported("test-module", mod, func() { registered = true })
+
+	if !registered {
+		t.Fatalf("expected module to be registered when its minimum kernel is trivially satisfied")
+	}
+}
+
+func TestRegisterIfSupported_HidesWhenKernelTooNew(t *testing.T) {
+	mod := fakeRequirementsModule{requirements: Requirements{MinKernel: kernel.VersionCode(99, 0, 0)}}
+	registered := false
+
+	RegisterIfSupported("test-module", mod, func() { registered = true })
+
+	if registered {
+		t.Fatalf("expected module to be hidden; no host runs kernel 99.0")
+	}
+}
@@ -0,0 +1,441 @@
+//go:build !androidgki
+
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"bytes"
+	"ecapture/user/event"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	manager "github.com/gojue/ebpfmanager"
+)
+
+// postgresClientMessageTypes are the Postgres wire-protocol message types the
+// client decoder understands; everything else is passed through unparsed.
+// pgMsgStartup isn't a real wire-protocol type byte (the StartupMessage has
+// none - it's the one message in the protocol with no leading type byte) and
+// is used internally to tag the synthesized message Feed carves off the front
+// of a fresh connection.
+const (
+	pgMsgStartup         byte = 0
+	pgMsgQuery           byte = 'Q'
+	pgMsgParse           byte = 'P'
+	pgMsgBind            byte = 'B'
+	pgMsgError           byte = 'E'
+	pgMsgDataRow         byte = 'D'
+	pgMsgRowDescription  byte = 'T'
+	pgMsgCommandComplete byte = 'C'
+)
+
+// pgProtocolVersion3 is the protocol version every currently-supported
+// Postgres server speaks, used to recognize a StartupMessage.
+const pgProtocolVersion3 = 0x00030000
+
+// connectionTTL bounds how long a connection's partial-message buffer is kept
+// around without being touched again, so a --client capture that runs for a
+// long time doesn't leak one buffer per SSL connection ever observed.
+const connectionTTL = 10 * time.Minute
+
+// sslConnKey identifies a single SSL-wrapped connection, the same way the
+// openssl module keys its own per-connection state.
+type sslConnKey struct {
+	pid    uint32
+	sslPtr uint64
+}
+
+// postgresClientDecoder reconstructs Postgres wire-protocol messages out of
+// the decrypted byte stream the openssl module's SSL_read/SSL_write uprobes
+// observe, buffering partial reads per connection since a single SSL_read
+// can return less than a full message (or more than one).
+type postgresClientDecoder struct {
+	mu    sync.Mutex
+	conns map[sslConnKey]*clientConnState
+}
+
+// clientConnState is the per-connection buffering state: the bytes of a
+// trailing partial message, whether the leading StartupMessage (the one
+// message with no type byte) has already been stripped off, and when this
+// connection was last touched so connectionTTL can sweep entries for
+// connections that were never explicitly closed.
+type clientConnState struct {
+	buf             []byte
+	startupConsumed bool
+	lastTouched     time.Time
+}
+
+func newPostgresClientDecoder() *postgresClientDecoder {
+	return &postgresClientDecoder{conns: make(map[sslConnKey]*clientConnState)}
+}
+
+// postgresWireMessage is one fully reassembled message out of the stream.
+type postgresWireMessage struct {
+	Type byte
+	Body []byte
+}
+
+// Feed appends newData to the buffer for key and extracts every complete
+// message it can, leaving any trailing partial message buffered for the next
+// call. Postgres wire messages are [type:1][length:4 big-endian incl.
+// self][body], except the very first message on a connection (the
+// StartupMessage), which has no leading type byte and is instead
+// [length:4 big-endian incl. self][protocol version:4][params...].
+func (d *postgresClientDecoder) Feed(key sslConnKey, newData []byte) []postgresWireMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for k, c := range d.conns {
+		if now.Sub(c.lastTouched) > connectionTTL {
+			delete(d.conns, k)
+		}
+	}
+
+	conn, ok := d.conns[key]
+	if !ok {
+		conn = &clientConnState{}
+		d.conns[key] = conn
+	}
+	conn.lastTouched = now
+	conn.buf = append(conn.buf, newData...)
+
+	var messages []postgresWireMessage
+
+	if !conn.startupConsumed {
+		msg, rest, matched, wait := extractStartupMessage(conn.buf)
+		if wait {
+			return messages
+		}
+		conn.startupConsumed = true
+		if matched {
+			messages = append(messages, msg)
+			conn.buf = rest
+		}
+	}
+
+	buf := conn.buf
+	for {
+		if len(buf) < 5 {
+			break
+		}
+		msgLen := int(buf[1])<<24 | int(buf[2])<<16 | int(buf[3])<<8 | int(buf[4])
+		// msgLen includes itself but not the leading type byte.
+		total := 1 + msgLen
+		if total > len(buf) {
+			break
+		}
+
+		messages = append(messages, postgresWireMessage{
+			Type: buf[0],
+			Body: append([]byte(nil), buf[5:total]...),
+		})
+		buf = buf[total:]
+	}
+	conn.buf = buf
+
+	return messages
+}
+
+// extractStartupMessage recognizes the StartupMessage that precedes all
+// other traffic on a fresh connection and has no leading type byte, unlike
+// every other message in the protocol. wait is true when there isn't enough
+// data yet to tell either way.
+func extractStartupMessage(buf []byte) (msg postgresWireMessage, rest []byte, matched, wait bool) {
+	if len(buf) < 8 {
+		return postgresWireMessage{}, buf, false, true
+	}
+	length := binary.BigEndian.Uint32(buf[:4])
+	protocol := binary.BigEndian.Uint32(buf[4:8])
+	if protocol != pgProtocolVersion3 {
+		return postgresWireMessage{}, buf, false, false
+	}
+	if int(length) > len(buf) {
+		return postgresWireMessage{}, buf, false, true
+	}
+	return postgresWireMessage{Type: pgMsgStartup, Body: append([]byte(nil), buf[8:length]...)}, buf[length:], true, false
+}
+
+// describePostgresWireMessage renders one reassembled wire message as the
+// query text, parameters or row data it carries, falling back to the message
+// type and body length for the ones the decoder doesn't interpret.
+func describePostgresWireMessage(m postgresWireMessage) string {
+	switch m.Type {
+	case pgMsgStartup:
+		return fmt.Sprintf("StartupMessage: %s", describeStartupParams(m.Body))
+	case pgMsgQuery:
+		return fmt.Sprintf("Query: %s", trimNulString(m.Body))
+	case pgMsgParse:
+		statement, rest, ok := readCString(m.Body)
+		if !ok {
+			return "Parse (malformed)"
+		}
+		query, _, ok := readCString(rest)
+		if !ok {
+			return "Parse (malformed)"
+		}
+		return fmt.Sprintf("Parse statement=%q: %s", statement, query)
+	case pgMsgBind:
+		portal, statement, params, ok := parseBindMessage(m.Body)
+		if !ok {
+			return "Bind (malformed)"
+		}
+		return fmt.Sprintf("Bind portal=%q statement=%q params=[%s]", portal, statement, strings.Join(params, ", "))
+	case pgMsgError:
+		return fmt.Sprintf("Error: %s", trimNulString(m.Body))
+	case pgMsgDataRow:
+		values, ok := parseDataRow(m.Body)
+		if !ok {
+			return "DataRow (malformed)"
+		}
+		return fmt.Sprintf("DataRow [%s]", strings.Join(values, ", "))
+	case pgMsgRowDescription:
+		names, ok := parseRowDescription(m.Body)
+		if !ok {
+			return "RowDescription (malformed)"
+		}
+		return fmt.Sprintf("RowDescription [%s]", strings.Join(names, ", "))
+	case pgMsgCommandComplete:
+		return fmt.Sprintf("CommandComplete: %s", trimNulString(m.Body))
+	default:
+		return fmt.Sprintf("%c(%d bytes)", m.Type, len(m.Body))
+	}
+}
+
+func trimNulString(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
+
+// readCString reads a single NUL-terminated string off the front of b,
+// the encoding the wire protocol uses for names throughout.
+func readCString(b []byte) (s string, rest []byte, ok bool) {
+	idx := bytes.IndexByte(b, 0)
+	if idx < 0 {
+		return "", b, false
+	}
+	return string(b[:idx]), b[idx+1:], true
+}
+
+// describeStartupParams renders a StartupMessage's trailing
+// key\0value\0...\0 run of connection parameters (user, database, ...).
+func describeStartupParams(body []byte) string {
+	var parts []string
+	r := body
+	for {
+		key, rest, ok := readCString(r)
+		if !ok || key == "" {
+			break
+		}
+		val, rest2, ok := readCString(rest)
+		if !ok {
+			break
+		}
+		parts = append(parts, key+"="+val)
+		r = rest2
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseBindMessage extracts the portal/statement names and bound parameter
+// values out of a Bind message, skipping over the format-code arrays (which
+// only affect how a param's bytes are encoded, not what value it carries).
+func parseBindMessage(body []byte) (portal, statement string, params []string, ok bool) {
+	r := body
+	if portal, r, ok = readCString(r); !ok {
+		return
+	}
+	if statement, r, ok = readCString(r); !ok {
+		return
+	}
+
+	numFormats, r, ok := readInt16(r)
+	if !ok {
+		return
+	}
+	if r, ok = skipBytes(r, 2*int(numFormats)); !ok {
+		return
+	}
+
+	numParams, r, ok := readInt16(r)
+	if !ok {
+		return
+	}
+	params = make([]string, 0, numParams)
+	for i := 0; i < int(numParams); i++ {
+		var value []byte
+		if value, r, ok = readLengthPrefixedValue(r); !ok {
+			return
+		}
+		if value == nil {
+			params = append(params, "NULL")
+		} else {
+			params = append(params, displayParamValue(value))
+		}
+	}
+	ok = true
+	return
+}
+
+// parseRowDescription extracts just the column names out of a
+// RowDescription message, skipping the per-column type metadata.
+func parseRowDescription(body []byte) (names []string, ok bool) {
+	numFields, r, ok := readInt16(body)
+	if !ok {
+		return nil, false
+	}
+	names = make([]string, 0, numFields)
+	for i := 0; i < int(numFields); i++ {
+		var name string
+		if name, r, ok = readCString(r); !ok {
+			return nil, false
+		}
+		// tableOID(4) + columnAttrNum(2) + typeOID(4) + typeLen(2) + typmod(4) + formatCode(2)
+		if r, ok = skipBytes(r, 18); !ok {
+			return nil, false
+		}
+		names = append(names, name)
+	}
+	return names, true
+}
+
+// parseDataRow extracts each column's value out of a DataRow message.
+func parseDataRow(body []byte) (values []string, ok bool) {
+	numFields, r, ok := readInt16(body)
+	if !ok {
+		return nil, false
+	}
+	values = make([]string, 0, numFields)
+	for i := 0; i < int(numFields); i++ {
+		var value []byte
+		if value, r, ok = readLengthPrefixedValue(r); !ok {
+			return nil, false
+		}
+		if value == nil {
+			values = append(values, "NULL")
+		} else {
+			values = append(values, displayParamValue(value))
+		}
+	}
+	return values, true
+}
+
+func readInt16(b []byte) (v int16, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return 0, b, false
+	}
+	return int16(binary.BigEndian.Uint16(b[:2])), b[2:], true
+}
+
+func skipBytes(b []byte, n int) ([]byte, bool) {
+	if len(b) < n {
+		return b, false
+	}
+	return b[n:], true
+}
+
+// readLengthPrefixedValue reads a Bind-parameter/DataRow-column value: a
+// big-endian int32 length followed by that many bytes, where a length of -1
+// means SQL NULL (represented here as a nil slice).
+func readLengthPrefixedValue(b []byte) (value, rest []byte, ok bool) {
+	if len(b) < 4 {
+		return nil, b, false
+	}
+	length := int32(binary.BigEndian.Uint32(b[:4]))
+	b = b[4:]
+	if length < 0 {
+		return nil, b, true
+	}
+	if len(b) < int(length) {
+		return nil, b, false
+	}
+	return b[:length], b[length:], true
+}
+
+// displayParamValue renders a parameter/column value for display, printing
+// it as text when it looks printable and falling back to a byte count for
+// binary-format values we can't usefully render as text.
+func displayParamValue(b []byte) string {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Sprintf("<%d bytes binary>", len(b))
+		}
+	}
+	return string(b)
+}
+
+// postgresClientEventDecoder wraps event.PostgresClientEvent, feeding every
+// decrypted SSL_read/SSL_write buffer through the module's
+// postgresClientDecoder so the reassembled wire messages - not just the raw
+// bytes - are what gets printed.
+type postgresClientEventDecoder struct {
+	module   *PostgresModule
+	inner    event.PostgresClientEvent
+	messages []postgresWireMessage
+}
+
+func (d *postgresClientEventDecoder) Decode(payload []byte) error {
+	if err := d.inner.Decode(payload); err != nil {
+		return err
+	}
+
+	key := sslConnKey{pid: d.inner.Pid, sslPtr: d.inner.SSLPointer}
+	d.messages = d.module.clientDecoder.Feed(key, d.inner.DataBytes())
+	return nil
+}
+
+func (d *postgresClientEventDecoder) String() string {
+	if len(d.messages) == 0 {
+		return fmt.Sprintf("%s (buffering, no complete message yet)", d.inner.String())
+	}
+
+	parts := make([]string, 0, len(d.messages))
+	for _, m := range d.messages {
+		parts = append(parts, describePostgresWireMessage(m))
+	}
+	return fmt.Sprintf("%s, %s", d.inner.String(), strings.Join(parts, "; "))
+}
+
+func (d *postgresClientEventDecoder) Clone() event.IEventStruct {
+	return &postgresClientEventDecoder{module: d.module}
+}
+
+func (d *postgresClientEventDecoder) EventType() event.EventType {
+	return d.inner.EventType()
+}
+
+// clientUprobes returns the SSL_read/SSL_write uprobes reused from the
+// openssl module so Postgres traffic can be observed client-side (psql,
+// pgbouncer) without touching the server binary, e.g. when sslmode=require
+// hides the query text from the server-side exec_simple_query uprobe.
+func clientUprobes(opensslPath string) []*manager.Probe {
+	return []*manager.Probe{
+		{
+			Section:          "uprobe/SSL_read",
+			EbpfFuncName:     "postgres_client_ssl_read",
+			AttachToFuncName: "SSL_read",
+			BinaryPath:       opensslPath,
+		},
+		{
+			Section:          "uprobe/SSL_write",
+			EbpfFuncName:     "postgres_client_ssl_write",
+			AttachToFuncName: "SSL_write",
+			BinaryPath:       opensslPath,
+		},
+	}
+}
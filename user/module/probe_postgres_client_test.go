@@ -0,0 +1,244 @@
+//go:build !androidgki
+
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// startupMessageBytes builds a StartupMessage: [length:4][protocol:4][params...].
+func startupMessageBytes(params ...string) []byte {
+	body := []byte{0, 3, 0, 0} // protocol version 3.0
+	for _, p := range params {
+		body = append(body, p...)
+		body = append(body, 0)
+	}
+	body = append(body, 0)
+	length := uint32(4 + len(body))
+	out := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(out, length)
+	return append(out, body...)
+}
+
+func postgresWireBytes(msgType byte, body string) []byte {
+	buf := make([]byte, 0, 5+len(body))
+	length := uint32(4 + len(body))
+	buf = append(buf, msgType, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	buf = append(buf, body...)
+	return buf
+}
+
+func TestPostgresClientDecoder_FeedWholeMessage(t *testing.T) {
+	d := newPostgresClientDecoder()
+	key := sslConnKey{pid: 1, sslPtr: 0x1234}
+
+	messages := d.Feed(key, postgresWireBytes(pgMsgQuery, "SELECT 1"))
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	if messages[0].Type != pgMsgQuery || !bytes.Equal(messages[0].Body, []byte("SELECT 1")) {
+		t.Errorf("message = %+v, want Query SELECT 1", messages[0])
+	}
+	if len(d.conns[key].buf) != 0 {
+		t.Errorf("expected no buffered bytes after a whole message, got %d", len(d.conns[key].buf))
+	}
+}
+
+func TestPostgresClientDecoder_FeedSplitAcrossReads(t *testing.T) {
+	d := newPostgresClientDecoder()
+	key := sslConnKey{pid: 1, sslPtr: 0x1234}
+	full := postgresWireBytes(pgMsgQuery, "SELECT * FROM users")
+
+	if messages := d.Feed(key, full[:3]); len(messages) != 0 {
+		t.Fatalf("got %d messages from a partial header, want 0", len(messages))
+	}
+	if messages := d.Feed(key, full[3:len(full)-5]); len(messages) != 0 {
+		t.Fatalf("got %d messages from a partial body, want 0", len(messages))
+	}
+
+	messages := d.Feed(key, full[len(full)-5:])
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages after the final chunk, want 1", len(messages))
+	}
+	if !bytes.Equal(messages[0].Body, []byte("SELECT * FROM users")) {
+		t.Errorf("body = %q, want %q", messages[0].Body, "SELECT * FROM users")
+	}
+}
+
+func TestPostgresClientDecoder_FeedMultipleMessagesInOneRead(t *testing.T) {
+	d := newPostgresClientDecoder()
+	key := sslConnKey{pid: 1, sslPtr: 0x1234}
+
+	combined := append(postgresWireBytes(pgMsgParse, "SELECT 1"), postgresWireBytes(pgMsgBind, "")...)
+	messages := d.Feed(key, combined)
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(messages))
+	}
+	if messages[0].Type != pgMsgParse || messages[1].Type != pgMsgBind {
+		t.Errorf("got types %c, %c, want P, B", messages[0].Type, messages[1].Type)
+	}
+}
+
+func TestPostgresClientDecoder_StripsStartupMessage(t *testing.T) {
+	d := newPostgresClientDecoder()
+	key := sslConnKey{pid: 1, sslPtr: 0x1234}
+
+	combined := append(startupMessageBytes("user", "alice", "database", "appdb"), postgresWireBytes(pgMsgQuery, "SELECT 1")...)
+	messages := d.Feed(key, combined)
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2 (StartupMessage + Query)", len(messages))
+	}
+	if messages[0].Type != pgMsgStartup {
+		t.Errorf("messages[0].Type = %c, want StartupMessage sentinel", messages[0].Type)
+	}
+	if got := describePostgresWireMessage(messages[0]); got != "StartupMessage: user=alice database=appdb" {
+		t.Errorf("describePostgresWireMessage(startup) = %q", got)
+	}
+	if messages[1].Type != pgMsgQuery {
+		t.Errorf("messages[1].Type = %c, want Query", messages[1].Type)
+	}
+
+	// A second Feed call on the same connection must not try to reparse a
+	// StartupMessage out of ordinary traffic.
+	more := d.Feed(key, postgresWireBytes(pgMsgQuery, "SELECT 2"))
+	if len(more) != 1 || more[0].Type != pgMsgQuery {
+		t.Fatalf("got %+v, want a single Query message", more)
+	}
+}
+
+func TestPostgresClientDecoder_EvictsStaleConnections(t *testing.T) {
+	d := newPostgresClientDecoder()
+	key := sslConnKey{pid: 1, sslPtr: 0x1234}
+
+	d.Feed(key, postgresWireBytes(pgMsgQuery, "SELECT 1"))
+	if _, ok := d.conns[key]; !ok {
+		t.Fatalf("expected connection state to exist after Feed")
+	}
+
+	d.conns[key].lastTouched = time.Now().Add(-connectionTTL - time.Second)
+	otherKey := sslConnKey{pid: 2, sslPtr: 0x5678}
+	d.Feed(otherKey, postgresWireBytes(pgMsgQuery, "SELECT 2"))
+
+	if _, ok := d.conns[key]; ok {
+		t.Errorf("expected stale connection to be evicted once its TTL passed")
+	}
+}
+
+func TestPostgresClientDecoder_SeparatesConnections(t *testing.T) {
+	d := newPostgresClientDecoder()
+	keyA := sslConnKey{pid: 1, sslPtr: 0xaaaa}
+	keyB := sslConnKey{pid: 1, sslPtr: 0xbbbb}
+
+	full := postgresWireBytes(pgMsgQuery, "SELECT 1")
+	d.Feed(keyA, full[:3])
+	if messages := d.Feed(keyB, full); len(messages) != 1 {
+		t.Fatalf("connection B should decode independently of A's partial buffer, got %d messages", len(messages))
+	}
+	if len(d.conns[keyA].buf) != 3 {
+		t.Errorf("connection A's partial buffer should be untouched, got %d bytes", len(d.conns[keyA].buf))
+	}
+}
+
+// bindMessageBytes builds a Bind message body with no format codes and the
+// given parameter values (nil entries encode SQL NULL).
+func bindMessageBytes(portal, statement string, params [][]byte) []byte {
+	body := []byte(portal)
+	body = append(body, 0)
+	body = append(body, statement...)
+	body = append(body, 0)
+	body = append(body, 0, 0) // numParamFormatCodes = 0
+
+	numParams := make([]byte, 2)
+	binary.BigEndian.PutUint16(numParams, uint16(len(params)))
+	body = append(body, numParams...)
+
+	for _, p := range params {
+		length := make([]byte, 4)
+		if p == nil {
+			binary.BigEndian.PutUint32(length, 0xffffffff) // -1
+			body = append(body, length...)
+			continue
+		}
+		binary.BigEndian.PutUint32(length, uint32(len(p)))
+		body = append(body, length...)
+		body = append(body, p...)
+	}
+	body = append(body, 0, 0) // numResultFormatCodes = 0
+	return body
+}
+
+func TestDescribePostgresWireMessage_Bind(t *testing.T) {
+	body := bindMessageBytes("", "stmt1", [][]byte{[]byte("42"), nil})
+	got := describePostgresWireMessage(postgresWireMessage{Type: pgMsgBind, Body: body})
+	want := `Bind portal="" statement="stmt1" params=[42, NULL]`
+	if got != want {
+		t.Errorf("describePostgresWireMessage(Bind) = %q, want %q", got, want)
+	}
+}
+
+// rowDescriptionBytes builds a RowDescription body naming each of names,
+// with placeholder type metadata.
+func rowDescriptionBytes(names ...string) []byte {
+	body := make([]byte, 2)
+	binary.BigEndian.PutUint16(body, uint16(len(names)))
+	for _, name := range names {
+		body = append(body, name...)
+		body = append(body, 0)
+		body = append(body, make([]byte, 18)...) // tableOID/colAttr/typeOID/typeLen/typmod/format
+	}
+	return body
+}
+
+func TestDescribePostgresWireMessage_RowDescription(t *testing.T) {
+	body := rowDescriptionBytes("id", "name")
+	got := describePostgresWireMessage(postgresWireMessage{Type: pgMsgRowDescription, Body: body})
+	want := "RowDescription [id, name]"
+	if got != want {
+		t.Errorf("describePostgresWireMessage(RowDescription) = %q, want %q", got, want)
+	}
+}
+
+// dataRowBytes builds a DataRow body carrying values (nil entries encode
+// SQL NULL).
+func dataRowBytes(values ...[]byte) []byte {
+	body := make([]byte, 2)
+	binary.BigEndian.PutUint16(body, uint16(len(values)))
+	for _, v := range values {
+		length := make([]byte, 4)
+		if v == nil {
+			binary.BigEndian.PutUint32(length, 0xffffffff)
+			body = append(body, length...)
+			continue
+		}
+		binary.BigEndian.PutUint32(length, uint32(len(v)))
+		body = append(body, length...)
+		body = append(body, v...)
+	}
+	return body
+}
+
+func TestDescribePostgresWireMessage_DataRow(t *testing.T) {
+	body := dataRowBytes([]byte("1"), []byte("alice"), nil)
+	got := describePostgresWireMessage(postgresWireMessage{Type: pgMsgDataRow, Body: body})
+	want := "DataRow [1, alice, NULL]"
+	if got != want {
+		t.Errorf("describePostgresWireMessage(DataRow) = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,103 @@
+//go:build !androidgki
+
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"ecapture/user/event"
+	"testing"
+	"time"
+)
+
+func newTestPostgresModule() *PostgresModule {
+	return &PostgresModule{statements: make(map[string]*preparedStatement)}
+}
+
+func extendedEvent(msgType event.PostgresMessageType, pid uint32, statementName, query string) *event.PostgresExtendedEvent {
+	e := &event.PostgresExtendedEvent{MessageType: msgType, Pid: pid}
+	copy(e.StatementName[:], statementName)
+	copy(e.Query[:], query)
+	return e
+}
+
+func TestHandleExtendedEvent_StitchesNamedStatement(t *testing.T) {
+	m := newTestPostgresModule()
+
+	if _, matched := m.handleExtendedEvent(extendedEvent(event.PostgresMessageParse, 1, "stmt1", "SELECT * FROM users WHERE id = $1")); matched {
+		t.Fatalf("Parse should not report a matched statement")
+	}
+
+	query, matched := m.handleExtendedEvent(extendedEvent(event.PostgresMessageExecute, 1, "stmt1", ""))
+	if !matched {
+		t.Fatalf("Execute should match the previously Parsed statement")
+	}
+	if want := "SELECT * FROM users WHERE id = $1"; query != want {
+		t.Fatalf("query = %q, want %q", query, want)
+	}
+}
+
+func TestHandleExtendedEvent_UnnamedPortalFallsBackToOwnQuery(t *testing.T) {
+	m := newTestPostgresModule()
+
+	query, matched := m.handleExtendedEvent(extendedEvent(event.PostgresMessageBind, 1, "", "SELECT 1"))
+	if !matched {
+		t.Fatalf("Bind with no matching Parse should still report matched=true using its own query text")
+	}
+	if want := "SELECT 1"; query != want {
+		t.Fatalf("query = %q, want %q", query, want)
+	}
+}
+
+func TestHandleExtendedEvent_BindRefreshesTTLForLongLivedStatement(t *testing.T) {
+	m := newTestPostgresModule()
+
+	m.handleExtendedEvent(extendedEvent(event.PostgresMessageParse, 1, "stmt1", "SELECT * FROM users WHERE id = $1"))
+
+	// Simulate the statement sitting idle for just under statementTTL, then
+	// being Bound again - it hasn't aged out yet, so the Bind still finds it.
+	m.statements[statementKey(1, "stmt1")].lastUsedAt = time.Now().Add(-statementTTL + time.Second)
+	if _, matched := m.handleExtendedEvent(extendedEvent(event.PostgresMessageBind, 1, "stmt1", "")); !matched {
+		t.Fatalf("Bind on a statement parsed long ago should still match before it's swept")
+	}
+
+	// The Bind above should have refreshed lastUsedAt; aging it by less than
+	// the TTL again should leave the statement intact for the Execute, which
+	// it would not if the Bind had left the old timestamp in place.
+	stmt := m.statements[statementKey(1, "stmt1")]
+	stmt.lastUsedAt = stmt.lastUsedAt.Add(-statementTTL / 2)
+	query, matched := m.handleExtendedEvent(extendedEvent(event.PostgresMessageExecute, 1, "stmt1", ""))
+	if !matched {
+		t.Fatalf("Execute should still match the Bind-refreshed statement")
+	}
+	if want := "SELECT * FROM users WHERE id = $1"; query != want {
+		t.Fatalf("query = %q, want %q", query, want)
+	}
+}
+
+func TestHandleExtendedEvent_SeparatesDifferentPids(t *testing.T) {
+	m := newTestPostgresModule()
+
+	m.handleExtendedEvent(extendedEvent(event.PostgresMessageParse, 1, "stmt1", "SELECT 1"))
+	m.handleExtendedEvent(extendedEvent(event.PostgresMessageParse, 2, "stmt1", "SELECT 2"))
+
+	query, matched := m.handleExtendedEvent(extendedEvent(event.PostgresMessageExecute, 2, "stmt1", ""))
+	if !matched {
+		t.Fatalf("Execute should match pid 2's Parsed statement")
+	}
+	if want := "SELECT 2"; query != want {
+		t.Fatalf("query = %q, want %q", query, want)
+	}
+}
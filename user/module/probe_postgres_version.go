@@ -0,0 +1,153 @@
+//go:build !androidgki
+
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"os/exec"
+	"regexp"
+)
+
+// ProbeSpec describes the attach point and struct layout to use for a given
+// Postgres major version, since symbol signatures and internal struct layouts
+// (Portal, QueryDesc, PlannedStmt) shift between major versions.
+type ProbeSpec struct {
+	// FuncName is the function exec_simple_query's uprobe attaches to for this version.
+	FuncName string
+	// PortalOffset is the byte offset of Portal.queryDesc for this version.
+	PortalOffset uint64
+	// CachedPlanSourceOffset is the byte offset of CachedPlanSource.query_string for this version.
+	CachedPlanSourceOffset uint64
+}
+
+// postgresProbeSpecs maps a Postgres major version, expressed the same way
+// CloudNativePG maps image tags to numeric versions (14 -> 140000), to the
+// probe spec that matches its internals.
+var postgresProbeSpecs = map[int]ProbeSpec{
+	120000: {FuncName: "exec_simple_query", PortalOffset: 0x28, CachedPlanSourceOffset: 0x18},
+	130000: {FuncName: "exec_simple_query", PortalOffset: 0x28, CachedPlanSourceOffset: 0x18},
+	140000: {FuncName: "exec_simple_query", PortalOffset: 0x30, CachedPlanSourceOffset: 0x18},
+	150000: {FuncName: "exec_simple_query", PortalOffset: 0x30, CachedPlanSourceOffset: 0x20},
+	160000: {FuncName: "exec_simple_query", PortalOffset: 0x38, CachedPlanSourceOffset: 0x20},
+}
+
+const (
+	postgresMinSupportedVersion = 120000
+	postgresMaxSupportedVersion = 160000
+)
+
+var pgVersionStringRegex = regexp.MustCompile(`PostgreSQL (\d+)\.?(\d+)?`)
+
+// detectPostgresVersion resolves the numeric Postgres server version (e.g.
+// 14.2 -> 140002) of the binary at binaryPath, trying progressively more
+// expensive strategies:
+//  1. read the PG_VERSION_STR symbol string out of the ELF .rodata section;
+//  2. fall back to spawning `postgres --version`.
+func detectPostgresVersion(binaryPath string) (int, error) {
+	if v, err := detectPostgresVersionFromELF(binaryPath); err == nil {
+		return v, nil
+	}
+
+	if v, err := detectPostgresVersionFromCLI(binaryPath); err == nil {
+		return v, nil
+	}
+
+	return 0, fmt.Errorf("couldn't detect postgres version for binary %s", binaryPath)
+}
+
+// detectPostgresVersionFromELF scans .rodata for the PG_VERSION_STR literal,
+// e.g. "PostgreSQL 14.9 on x86_64-pc-linux-gnu, ...".
+func detectPostgresVersionFromELF(binaryPath string) (int, error) {
+	f, err := elf.Open(binaryPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	section := f.Section(".rodata")
+	if section == nil {
+		return 0, fmt.Errorf(".rodata section not found in %s", binaryPath)
+	}
+
+	data, err := section.Data()
+	if err != nil {
+		return 0, err
+	}
+
+	idx := bytes.Index(data, []byte("PostgreSQL "))
+	if idx < 0 {
+		return 0, fmt.Errorf("PG_VERSION_STR not found in %s", binaryPath)
+	}
+
+	end := idx + 64
+	if end > len(data) {
+		end = len(data)
+	}
+
+	return parsePostgresVersionString(string(data[idx:end]))
+}
+
+// detectPostgresVersionFromCLI falls back to running the traced binary itself
+// with --version when the version string can't be found in the ELF.
+func detectPostgresVersionFromCLI(binaryPath string) (int, error) {
+	out, err := exec.Command(binaryPath, "--version").Output()
+	if err != nil {
+		return 0, err
+	}
+	return parsePostgresVersionString(string(out))
+}
+
+func parsePostgresVersionString(s string) (int, error) {
+	match := pgVersionStringRegex.FindStringSubmatch(s)
+	if len(match) < 2 {
+		return 0, fmt.Errorf("failed to parse postgres version from %q", s)
+	}
+
+	var major, minor int
+	fmt.Sscanf(match[1], "%d", &major)
+	if len(match) >= 3 && match[2] != "" {
+		fmt.Sscanf(match[2], "%d", &minor)
+	}
+
+	// Postgres 10+ dropped the two-part major version; match[2] here is the
+	// minor release, not a second major component. This mirrors the numbering
+	// PQserverVersion() uses (e.g. 14.9 -> 140009, 16.3 -> 160003).
+	return major*10000 + minor, nil
+}
+
+// resolveProbeSpec picks the ProbeSpec matching the detected Postgres
+// version, refusing to start when the binary falls outside the supported
+// range rather than silently attaching with the wrong offsets. The supported
+// range is checked against the truncated major version, not the full
+// major+minor number, so e.g. 16.3 (160003) isn't rejected just because it's
+// numerically above the 16.0 (160000) catalog entry.
+func resolveProbeSpec(version int) (ProbeSpec, error) {
+	majorVersion := (version / 10000) * 10000
+
+	if majorVersion < postgresMinSupportedVersion || majorVersion > postgresMaxSupportedVersion {
+		return ProbeSpec{}, fmt.Errorf("postgres version %d is not supported, supported major-version range is [%d, %d]",
+			version, postgresMinSupportedVersion, postgresMaxSupportedVersion)
+	}
+
+	spec, found := postgresProbeSpecs[majorVersion]
+	if !found {
+		return ProbeSpec{}, fmt.Errorf("no probe spec registered for postgres major version %d", majorVersion)
+	}
+	return spec, nil
+}
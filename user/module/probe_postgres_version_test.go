@@ -0,0 +1,62 @@
+//go:build !androidgki
+
+// Copyright 2022 CFC4N <cfc4n.cs@gmail.com>. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package module
+
+import "testing"
+
+func TestParsePostgresVersionString(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int
+	}{
+		{"PostgreSQL 14.9 on x86_64-pc-linux-gnu, compiled by gcc", 140009},
+		{"PostgreSQL 16.3 on x86_64-pc-linux-gnu, compiled by gcc", 160003},
+		{"PostgreSQL 16.0 on x86_64-pc-linux-gnu, compiled by gcc", 160000},
+		{"PostgreSQL 12.1 on x86_64-pc-linux-gnu, compiled by gcc", 120001},
+	}
+
+	for _, c := range cases {
+		got, err := parsePostgresVersionString(c.in)
+		if err != nil {
+			t.Fatalf("parsePostgresVersionString(%q) returned error: %v", c.in, err)
+		}
+		if got != c.want {
+			t.Errorf("parsePostgresVersionString(%q) = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
+
+func TestResolveProbeSpec_PointReleasesAreSupported(t *testing.T) {
+	// 16.3 (160003) must resolve against the 16.0 (160000) catalog entry
+	// rather than being rejected as "above" it.
+	spec, err := resolveProbeSpec(160003)
+	if err != nil {
+		t.Fatalf("resolveProbeSpec(160003) returned error: %v", err)
+	}
+	if want := postgresProbeSpecs[160000]; spec != want {
+		t.Errorf("resolveProbeSpec(160003) = %+v, want %+v", spec, want)
+	}
+}
+
+func TestResolveProbeSpec_OutOfRangeRejected(t *testing.T) {
+	if _, err := resolveProbeSpec(170001); err == nil {
+		t.Fatalf("resolveProbeSpec(170001) should fail, postgres 17 isn't in the catalog")
+	}
+	if _, err := resolveProbeSpec(90005); err == nil {
+		t.Fatalf("resolveProbeSpec(90005) should fail, postgres 9 is below the supported range")
+	}
+}